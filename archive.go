@@ -7,10 +7,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-
-	gitignore "github.com/sabhiram/go-gitignore"
+	"sync/atomic"
+	"syscall"
 )
 
+// withinRoot reports whether path is root itself or a descendant of root,
+// comparing path components rather than raw byte prefixes so that a sibling
+// like "/tmp/out-secrets" is never mistaken for being inside "/tmp/out".
+func withinRoot(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
 func defaultOpts() *tarOptions {
 	return &tarOptions{
 		level: DefaultCompression,
@@ -18,18 +25,28 @@ func defaultOpts() *tarOptions {
 }
 
 type tarOptions struct {
-	honorGitIgnore bool
-	ignoreDotGit   bool
-	level          int
+	honorGitIgnore      bool
+	ignoreDotGit        bool
+	honorGitInfoExclude bool
+	level               int
+	chown               bool
+	preserveTimes       bool
+	includePaths        []string
+	excludePatterns     []string
+	rebaseNames         map[string]string
+	parallelGzip        bool
+	pgzipBlockSize      int
+	pgzipBlocks         int
+	bandwidthLimit      int64
+	progress            func(bytesWritten, filesWritten int64)
 }
 
 type TarOption func(*tarOptions)
 
-// HonorGitIgnore will look for a .gitignore file in '.',
-// parse it, and only archive files that are not matched by
-// a rule in this .gitignore file.
-// The current implementation does not support multiple
-// .gitignore files in multiple folders.
+// HonorGitIgnore looks for a .gitignore in the source root and in every
+// directory under it, and only archives files that none of them match. A
+// deeper .gitignore takes precedence over a shallower one for any pattern
+// it repeats or negates.
 func HonorGitIgnore() TarOption {
 	return func(opts *tarOptions) {
 		opts.honorGitIgnore = true
@@ -43,11 +60,66 @@ func IgnoreDotGit() TarOption {
 	}
 }
 
-// ArchiveGitRepo is a shorthand for HonorGitIgnore and IgnoreDotGit
+// ArchiveGitRepo is a shorthand for HonorGitIgnore and IgnoreDotGit that
+// additionally honors a repo-level .git/info/exclude, if present.
 func ArchiveGitRepo() TarOption {
 	return func(opts *tarOptions) {
 		opts.ignoreDotGit = true
 		opts.honorGitIgnore = true
+		opts.honorGitInfoExclude = true
+	}
+}
+
+// PreserveOwnership causes Untar to apply the Uid/Gid recorded in each tar
+// header to the extracted file via os.Lchown.
+func PreserveOwnership() TarOption {
+	return func(opts *tarOptions) {
+		opts.chown = true
+	}
+}
+
+// NoLchown turns the ownership restore enabled by PreserveOwnership back
+// off. It exists so a caller composing several option presets can dial
+// chown back off without having to conditionally omit PreserveOwnership.
+func NoLchown() TarOption {
+	return func(opts *tarOptions) {
+		opts.chown = false
+	}
+}
+
+// PreserveTimes causes Untar to apply the ModTime recorded in each tar
+// header to the extracted file via os.Chtimes.
+func PreserveTimes() TarOption {
+	return func(opts *tarOptions) {
+		opts.preserveTimes = true
+	}
+}
+
+// IncludePaths restricts Tar to walking only the given subtrees of source,
+// rather than source in its entirety. Paths are relative to source.
+// Defaults to []string{"."}.
+func IncludePaths(paths ...string) TarOption {
+	return func(opts *tarOptions) {
+		opts.includePaths = paths
+	}
+}
+
+// ExcludePatterns adds gitignore-style patterns that Tar matches in
+// addition to any .gitignore file enabled by HonorGitIgnore, so callers can
+// exclude paths without maintaining a .gitignore on disk.
+func ExcludePatterns(patterns ...string) TarOption {
+	return func(opts *tarOptions) {
+		opts.excludePatterns = patterns
+	}
+}
+
+// RebaseNames rewrites archived header names: a file under a key of rebase
+// is archived as if it lived under the corresponding value instead. For
+// example RebaseNames(map[string]string{"src": "app"}) archives
+// "src/foo.go" as "app/foo.go".
+func RebaseNames(rebase map[string]string) TarOption {
+	return func(opts *tarOptions) {
+		opts.rebaseNames = rebase
 	}
 }
 
@@ -56,7 +128,8 @@ func ArchiveGitRepo() TarOption {
 // It
 // * skips root
 // * maintains empty folders
-// * does not follow (symbolic) links
+// * does not follow symlinks: archives the link itself as TypeSymlink, not its target
+// * archives additional hardlinks to an already-seen file as TypeLink
 // * respects a .gitignore if it's found in the directory root
 func Tar(source string, writer io.Writer, opts ...TarOption) error {
 	tarOpts := defaultOpts()
@@ -64,6 +137,19 @@ func Tar(source string, writer io.Writer, opts ...TarOption) error {
 		opt(tarOpts)
 	}
 
+	if tarOpts.bandwidthLimit > 0 {
+		limiter := newRateLimitedWriter(writer, tarOpts.bandwidthLimit)
+		defer limiter.Close()
+		writer = limiter
+	}
+
+	return tarWithOpts(source, writer, tarOpts)
+}
+
+// tarWithOpts is the shared implementation behind Tar and the Compress
+// family, taking already-parsed tarOptions so compression wrappers don't
+// have to re-apply TarOptions on top of the ones they were given.
+func tarWithOpts(source string, writer io.Writer, tarOpts *tarOptions) error {
 	source = filepath.Clean(source)
 	// ensure the source actually exists before trying to tar it
 	sourceFi, err := os.Stat(source)
@@ -73,6 +159,23 @@ func Tar(source string, writer io.Writer, opts ...TarOption) error {
 		return fmt.Errorf("can only archive a directory")
 	}
 
+	var filesWritten int64
+	if tarOpts.progress != nil {
+		counter := &countingWriter{Writer: writer}
+		writer = counter
+
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		go reportProgress(tarOpts.progress, counter, &filesWritten, done, finished)
+		// block until reportProgress has made its final call, so Tar and
+		// Compress keep their promise that the callback sees final totals
+		// before they return, instead of racing the caller.
+		defer func() {
+			close(done)
+			<-finished
+		}()
+	}
+
 	tw := tar.NewWriter(writer)
 	defer tw.Close()
 	absSource, err := filepath.Abs(source)
@@ -80,15 +183,41 @@ func Tar(source string, writer io.Writer, opts ...TarOption) error {
 		return err
 	}
 
-	ignorer, err := newIgnorer(tarOpts, absSource)
+	ignores, err := newIgnoreStack(tarOpts, absSource)
 	if err != nil {
 		return err
 	}
 
-	return filepath.Walk(source, func(file string, fi os.FileInfo, err error) error {
+	// hardlinks maps an inode number to the relative path it was first
+	// archived under, so later links to the same inode can be written out
+	// as TypeLink entries instead of duplicating file contents.
+	hardlinks := map[uint64]string{}
+
+	includes := tarOpts.includePaths
+	if len(includes) == 0 {
+		includes = []string{"."}
+	}
+
+	for _, include := range includes {
+		err := filepath.Walk(filepath.Join(source, include), tarWalkFunc(tw, absSource, ignores, tarOpts.honorGitIgnore, tarOpts.rebaseNames, hardlinks, &filesWritten))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tarWalkFunc builds the filepath.WalkFunc used to add a single file or
+// directory to tw, applying ignore matching and RebaseNames along the way.
+func tarWalkFunc(tw *tar.Writer, absSource string, ignores *ignoreStack, honorGitIgnore bool, rebase map[string]string, hardlinks map[uint64]string, filesWritten *int64) filepath.WalkFunc {
+	return func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
-		} else if !fi.Mode().IsRegular() && !fi.Mode().IsDir() {
+		}
+
+		isSymlink := fi.Mode()&os.ModeSymlink != 0
+		if !fi.Mode().IsRegular() && !fi.Mode().IsDir() && !isSymlink {
 			return nil
 		}
 
@@ -102,13 +231,35 @@ func Tar(source string, writer io.Writer, opts ...TarOption) error {
 			return err
 		} else if relPath == "." {
 			return nil
-		} else if !strings.HasPrefix(absFile, absSource) {
+		} else if !withinRoot(absFile, absSource) {
 			return fmt.Errorf("illegal file path: [%s]", absFile)
-		} else if ignorer != nil && ignorer.MatchesPath(relPath) {
+		}
+
+		ignores.leave(filepath.Dir(relPath))
+		if ignores.matches(relPath) {
 			return nil
 		}
 
-		header, err := tar.FileInfoHeader(fi, fi.Name())
+		if fi.IsDir() && honorGitIgnore {
+			if err := ignores.enter(relPath, absFile); err != nil {
+				return err
+			}
+		}
+
+		var linkname string
+		if isSymlink {
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+
+			linkname, err = rebaseSymlinkTarget(absFile, target, absSource)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(fi, linkname)
 		if err != nil {
 			return err
 		}
@@ -118,13 +269,23 @@ func Tar(source string, writer io.Writer, opts ...TarOption) error {
 		// if the source folder is "./dir1" and dir1 contains
 		// a file f1.txt, then header name should be "f1.txt"
 		// and not "dir1/f1.txt"
-		header.Name = relPath
+		header.Name = rebaseName(relPath, rebase)
+
+		if fi.Mode().IsRegular() {
+			if target, ok := seenHardlink(fi, relPath, hardlinks); ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = target
+				header.Size = 0
+			}
+		}
+
 		err = tw.WriteHeader(header)
 		if err != nil {
 			return err
 		}
+		atomic.AddInt64(filesWritten, 1)
 
-		if fi.IsDir() {
+		if fi.IsDir() || isSymlink || header.Typeflag == tar.TypeLink {
 			return nil
 		}
 
@@ -136,13 +297,51 @@ func Tar(source string, writer io.Writer, opts ...TarOption) error {
 		defer f.Close()
 		_, err = io.Copy(tw, f)
 		return err
-	})
+	}
+}
+
+// rebaseSymlinkTarget rewrites an absolute symlink target into a path
+// relative to the symlink itself, so the archive stays portable. Absolute
+// targets that resolve outside absSource are refused rather than silently
+// archived; relative targets are returned unchanged and are not checked.
+func rebaseSymlinkTarget(absFile, target, absSource string) (string, error) {
+	if !filepath.IsAbs(target) {
+		return target, nil
+	}
+
+	absTarget := filepath.Clean(target)
+	if !withinRoot(absTarget, absSource) {
+		return "", fmt.Errorf("illegal symlink target: [%s] escapes [%s]", absTarget, absSource)
+	}
+
+	return filepath.Rel(filepath.Dir(absFile), absTarget)
+}
+
+// seenHardlink reports whether fi's inode has already been archived under a
+// different path, returning that path so the caller can emit a TypeLink
+// entry instead of a second copy of the file's contents.
+func seenHardlink(fi os.FileInfo, relPath string, seen map[uint64]string) (string, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return "", false
+	}
+
+	if target, found := seen[stat.Ino]; found {
+		return target, true
+	}
+
+	seen[stat.Ino] = relPath
+	return "", false
 }
 
 // Untar takes a destination path and a reader. A tar reader loops over the tarfile
 // creating the file structure at 'destination' along the way, and writing the files' contents.
-// TODO: make sure that every file that tries to leave the box is skipped
-func Untar(destination string, r io.Reader) error {
+func Untar(destination string, r io.Reader, opts ...TarOption) error {
+	tarOpts := defaultOpts()
+	for _, opt := range opts {
+		opt(tarOpts)
+	}
+
 	// ensure the destination actually exists before trying to untar into it
 	destinationFi, err := os.Stat(destination)
 	if err != nil {
@@ -165,32 +364,100 @@ func Untar(destination string, r io.Reader) error {
 			return err
 		}
 
-		// the target location where the dir/file should be created
-		target := filepath.Clean(filepath.Join(absDestination, header.Name))
-		if !strings.HasPrefix(target, absDestination) {
-			return fmt.Errorf("illegal file path: [%s]", target)
+		if err := extractEntry(tr, header, absDestination, tarOpts); err != nil {
+			return err
 		}
+	}
+}
 
-		// check the file type
-		if header.Typeflag == tar.TypeDir {
-			_, err = os.Stat(target)
-			if err != nil {
-				err = os.MkdirAll(target, os.FileMode(header.Mode))
-				if err != nil {
-					return err
-				}
-			}
-		} else if header.Typeflag == tar.TypeReg {
-			err = writeFile(tr, target, header.Mode)
-			if err != nil {
-				return err
-			}
+// extractEntry creates the file, directory, symlink or hardlink described by
+// header at its place under absDestination, then restores whatever
+// ownership/mtime metadata tarOpts asks for.
+func extractEntry(tr *tar.Reader, header *tar.Header, absDestination string, tarOpts *tarOptions) error {
+	// the target location where the dir/file should be created
+	target := filepath.Clean(filepath.Join(absDestination, header.Name))
+	if !withinRoot(target, absDestination) {
+		return fmt.Errorf("illegal file path: [%s]", target)
+	}
+
+	var err error
+	// check the file type
+	switch header.Typeflag {
+	case tar.TypeDir:
+		_, err = os.Stat(target)
+		if err != nil {
+			err = os.MkdirAll(target, os.FileMode(header.Mode))
 		}
+	case tar.TypeReg:
+		err = writeFile(tr, target, header.Mode)
+	case tar.TypeSymlink:
+		err = writeSymlink(target, header.Linkname, absDestination)
+	case tar.TypeLink:
+		err = writeHardlink(target, header.Linkname, absDestination)
+	}
+	if err != nil {
+		return err
 	}
+
+	return applyMetadata(target, header, tarOpts)
+}
+
+// writeSymlink recreates a symlink recorded in a tar header, refusing to
+// create one whose resolved target would escape absDestination.
+func writeSymlink(target, linkname, absDestination string) error {
+	resolved := linkname
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(filepath.Dir(target), resolved)
+	}
+
+	resolved = filepath.Clean(resolved)
+	if !withinRoot(resolved, absDestination) {
+		return fmt.Errorf("illegal symlink target: [%s] escapes [%s]", resolved, absDestination)
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	return os.Symlink(linkname, target)
+}
+
+// writeHardlink recreates a hardlink recorded in a tar header. Linkname is
+// relative to absDestination, the same root every other header name is
+// rooted at.
+func writeHardlink(target, linkname, absDestination string) error {
+	source := filepath.Clean(filepath.Join(absDestination, linkname))
+	if !withinRoot(source, absDestination) {
+		return fmt.Errorf("illegal link target: [%s] escapes [%s]", source, absDestination)
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	return os.Link(source, target)
+}
+
+// applyMetadata restores the ownership and/or modification time recorded in
+// header onto target, when the corresponding TarOption was set.
+func applyMetadata(target string, header *tar.Header, tarOpts *tarOptions) error {
+	if tarOpts.chown {
+		if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+			return err
+		}
+	}
+
+	if tarOpts.preserveTimes && header.Typeflag != tar.TypeSymlink {
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func writeFile(tr *tar.Reader, target string, mode int64) error {
-	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(mode))
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.FileMode(mode))
 	if err != nil {
 		return err
 	}
@@ -201,17 +468,18 @@ func writeFile(tr *tar.Reader, target string, mode int64) error {
 	return err
 }
 
-func newIgnorer(tarOpts *tarOptions, absSource string) (*gitignore.GitIgnore, error) {
-	var ignorer *gitignore.GitIgnore
-	var err error
-	if tarOpts.honorGitIgnore && tarOpts.ignoreDotGit {
-		gitignorePath := filepath.Join(absSource, ".gitignore")
-		ignorer, err = gitignore.CompileIgnoreFileAndLines(gitignorePath, "**/.git", ".gitignore")
-	} else if tarOpts.honorGitIgnore && !tarOpts.ignoreDotGit {
-		gitignorePath := filepath.Join(absSource, ".gitignore")
-		ignorer, err = gitignore.CompileIgnoreFileAndLines(gitignorePath, ".gitignore")
-	} else if !tarOpts.honorGitIgnore && tarOpts.ignoreDotGit {
-		ignorer = gitignore.CompileIgnoreLines("**/.git")
-	}
-	return ignorer, err
+// rebaseName rewrites relPath's leading path component per rebase, so a file
+// under a mapped key is archived under the corresponding value instead.
+func rebaseName(relPath string, rebase map[string]string) string {
+	for from, to := range rebase {
+		if relPath == from {
+			return to
+		}
+
+		prefix := from + string(filepath.Separator)
+		if strings.HasPrefix(relPath, prefix) {
+			return filepath.Join(to, strings.TrimPrefix(relPath, prefix))
+		}
+	}
+	return relPath
 }
@@ -0,0 +1,24 @@
+package archiver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebaseName(t *testing.T) {
+	rebase := map[string]string{"src": "app"}
+
+	tests := []struct {
+		relPath  string
+		expected string
+	}{
+		{"src", "app"},
+		{"src/foo.go", "app/foo.go"},
+		{"other/foo.go", "other/foo.go"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, rebaseName(test.relPath, rebase))
+	}
+}
@@ -0,0 +1,105 @@
+package archiver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebaseSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		name      string
+		absFile   string
+		target    string
+		absSource string
+		expected  string
+		wantErr   bool
+	}{
+		{
+			name:      "relative target is passed through",
+			absFile:   "/src/dir/link",
+			target:    "../other/file.txt",
+			absSource: "/src",
+			expected:  "../other/file.txt",
+		},
+		{
+			name:      "absolute target inside source is rebased",
+			absFile:   "/src/dir/link",
+			target:    "/src/other/file.txt",
+			absSource: "/src",
+			expected:  "../other/file.txt",
+		},
+		{
+			name:      "absolute target escaping source is refused",
+			absFile:   "/src/dir/link",
+			target:    "/etc/passwd",
+			absSource: "/src",
+			wantErr:   true,
+		},
+		{
+			name:      "absolute target under a sibling sharing a path prefix is refused",
+			absFile:   "/src/dir/link",
+			target:    "/src-secrets/flag",
+			absSource: "/src",
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := rebaseSymlinkTarget(test.absFile, test.target, test.absSource)
+			if test.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestWriteSymlinkRefusesSiblingPrefixEscape(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "link")
+	// dir's parent also contains "<base>-secrets", a sibling whose name
+	// happens to share dir as a byte prefix but is not inside it.
+	linkname := filepath.Join("..", filepath.Base(dir)+"-secrets", "flag")
+
+	err := writeSymlink(target, linkname, dir)
+	assert.NotNil(t, err)
+}
+
+func TestWriteHardlinkRefusesSiblingPrefixEscape(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "link")
+	linkname := filepath.Join("..", filepath.Base(dir)+"-secrets", "flag")
+
+	err := writeHardlink(target, linkname, dir)
+	assert.NotNil(t, err)
+}
+
+func TestSeenHardlink(t *testing.T) {
+	fi, err := os.Stat("archive.go")
+	assert.Nil(t, err)
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	assert.True(t, ok)
+
+	seen := map[uint64]string{stat.Ino: "archive.go"}
+
+	// a regular file with only one link is never reported as a hardlink,
+	// even if its inode happens to collide with a seeded entry
+	if stat.Nlink < 2 {
+		_, found := seenHardlink(fi, "other-path", seen)
+		assert.False(t, found)
+		return
+	}
+
+	target, found := seenHardlink(fi, "other-path", seen)
+	assert.True(t, found)
+	assert.Equal(t, "archive.go", target)
+}
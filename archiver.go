@@ -0,0 +1,222 @@
+package archiver
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Owner holds a fixed UID/GID pair an Archiver can force onto every file it
+// extracts, regardless of what's recorded in the archive.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// IDRange maps Size consecutive container IDs, starting at ContainerID,
+// onto the same number of host IDs starting at HostID - the shape a user
+// namespace's /proc/<pid>/uid_map uses.
+type IDRange struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// IDMap remaps UIDs and GIDs between a container's and the host's ID
+// space, so an Archiver can pack (ToContainer) and unpack (ToHost) files
+// as if running inside a user namespace it isn't actually in.
+type IDMap struct {
+	UIDs []IDRange
+	GIDs []IDRange
+}
+
+// ToHost maps a container UID/GID pair to the host IDs it corresponds to.
+func (m IDMap) ToHost(uid, gid int) (int, int) {
+	return mapID(m.UIDs, uid, true), mapID(m.GIDs, gid, true)
+}
+
+// ToContainer maps a host UID/GID pair to the container IDs it corresponds to.
+func (m IDMap) ToContainer(uid, gid int) (int, int) {
+	return mapID(m.UIDs, uid, false), mapID(m.GIDs, gid, false)
+}
+
+func (m IDMap) set() bool {
+	return len(m.UIDs) > 0 || len(m.GIDs) > 0
+}
+
+// mapID looks id up in ranges. If containerToHost, id is treated as a
+// container ID and mapped to the host ID it corresponds to; otherwise the
+// reverse. An id with no matching range passes through unchanged.
+func mapID(ranges []IDRange, id int, containerToHost bool) int {
+	for _, r := range ranges {
+		from, to := r.ContainerID, r.HostID
+		if !containerToHost {
+			from, to = r.HostID, r.ContainerID
+		}
+		if id >= from && id < from+r.Size {
+			return to + (id - from)
+		}
+	}
+	return id
+}
+
+// Archiver bundles a Tar/Untar implementation together with the ID
+// remapping and forced ownership it should apply, so callers can inject
+// custom extraction behavior (writing into an object store, a chroot, a
+// virtual filesystem, ...) while still getting the copy helpers below.
+type Archiver struct {
+	Tar       func(string, io.Writer, ...TarOption) error
+	Untar     func(string, io.Reader, ...TarOption) error
+	IDMap     IDMap
+	ChownOpts *Owner
+}
+
+// NewDefaultArchiver builds an Archiver backed by this package's own Tar
+// and Untar, with no ID remapping or forced ownership.
+func NewDefaultArchiver() *Archiver {
+	return &Archiver{
+		Tar:   Tar,
+		Untar: Untar,
+	}
+}
+
+// TarUntar streams the directory src through a.Tar and a.Untar into dst
+// via an in-memory pipe, so the copy preserves whatever mode, owner and
+// symlink metadata the tar format carries without needing a temp file.
+func (a *Archiver) TarUntar(src, dst string) error {
+	archive, err := a.tarFrom(src)
+	if err != nil {
+		return err
+	}
+
+	return a.untarInto(archive, dst)
+}
+
+// UntarPath opens the archive at archivePath and extracts it into dst
+// through a.Untar.
+func (a *Archiver) UntarPath(archivePath, dst string) error {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return a.untarInto(archive, dst)
+}
+
+// CopyWithTar copies src to dst, preserving mode, owner and symlinks. If
+// src is a directory its entire contents are copied; otherwise it behaves
+// like CopyFileWithTar.
+func (a *Archiver) CopyWithTar(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return a.CopyFileWithTar(src, dst)
+	}
+
+	if err := os.MkdirAll(dst, fi.Mode()); err != nil {
+		return err
+	}
+
+	return a.TarUntar(src, dst)
+}
+
+// CopyFileWithTar copies the single file at src to dst, preserving mode
+// and owner, by archiving just that file - renamed to dst's basename via
+// RebaseNames - and untarring it into dst's parent directory.
+func (a *Archiver) CopyFileWithTar(src, dst string) error {
+	srcDir, srcName := filepath.Split(src)
+	dstDir, dstName := filepath.Split(dst)
+	if dstDir == "" {
+		dstDir = "."
+	}
+
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+
+	archive, err := a.tarFrom(srcDir, IncludePaths(srcName), RebaseNames(map[string]string{srcName: dstName}))
+	if err != nil {
+		return err
+	}
+
+	return a.untarInto(archive, dstDir)
+}
+
+// tarFrom archives src via a.Tar and returns a reader over the result,
+// remapping every header's Uid/Gid from host to container space first if
+// a.IDMap is set.
+func (a *Archiver) tarFrom(src string, opts ...TarOption) (io.Reader, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(a.Tar(src, pw, opts...))
+	}()
+
+	if !a.IDMap.set() {
+		return pr, nil
+	}
+
+	return remapTarIDs(pr, a.IDMap.ToContainer)
+}
+
+// untarInto extracts r into dst through a.Untar, remapping Uid/Gid from
+// container to host space first if a.IDMap is set, or overwriting them
+// with a.ChownOpts if that's set instead. Each extracted entry is given the
+// Uid/Gid its header carries after that step.
+func (a *Archiver) untarInto(r io.Reader, dst string) error {
+	switch {
+	case a.IDMap.set():
+		remapped, err := remapTarIDs(r, a.IDMap.ToHost)
+		if err != nil {
+			return err
+		}
+		r = remapped
+	case a.ChownOpts != nil:
+		owner := *a.ChownOpts
+		remapped, err := remapTarIDs(r, func(int, int) (int, int) {
+			return owner.UID, owner.GID
+		})
+		if err != nil {
+			return err
+		}
+		r = remapped
+	}
+
+	return a.Untar(dst, r, PreserveOwnership())
+}
+
+// remapTarIDs returns a reader over r's tar stream with every header's
+// Uid/Gid passed through fn.
+func remapTarIDs(r io.Reader, fn func(uid, gid int) (int, int)) (io.Reader, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tr := tar.NewReader(r)
+		tw := tar.NewWriter(pw)
+
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				pw.CloseWithError(tw.Close())
+				return
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			header.Uid, header.Gid = fn(header.Uid, header.Gid)
+			if err := tw.WriteHeader(header); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	return pr, nil
+}
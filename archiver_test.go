@@ -0,0 +1,66 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDMapRoundTrip(t *testing.T) {
+	idMap := IDMap{
+		UIDs: []IDRange{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDs: []IDRange{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+
+	hostUID, hostGID := idMap.ToHost(1000, 1000)
+	assert.Equal(t, 101000, hostUID)
+	assert.Equal(t, 201000, hostGID)
+
+	containerUID, containerGID := idMap.ToContainer(hostUID, hostGID)
+	assert.Equal(t, 1000, containerUID)
+	assert.Equal(t, 1000, containerGID)
+}
+
+func TestIDMapPassesThroughUnmappedIDs(t *testing.T) {
+	idMap := IDMap{UIDs: []IDRange{{ContainerID: 0, HostID: 100000, Size: 10}}}
+
+	uid, _ := idMap.ToHost(50, 50)
+	assert.Equal(t, 50, uid)
+}
+
+func TestArchiverCopyWithTar(t *testing.T) {
+	src, err := ioutil.TempDir("", "TestArchiverCopyWithTar-src-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "TestArchiverCopyWithTar-dst-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dst)
+	assert.Nil(t, os.Remove(dst))
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "file.txt"), []byte("hello"), 0644))
+
+	a := NewDefaultArchiver()
+	assert.Nil(t, a.CopyWithTar(src, dst))
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "file.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(content))
+}
+
+func TestArchiverCopyFileWithTarRenames(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestArchiverCopyFileWithTarRenames-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "src.txt"), []byte("hello"), 0644))
+
+	a := NewDefaultArchiver()
+	assert.Nil(t, a.CopyFileWithTar(filepath.Join(root, "src.txt"), filepath.Join(root, "dst.txt")))
+
+	content, err := ioutil.ReadFile(filepath.Join(root, "dst.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(content))
+}
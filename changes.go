@@ -0,0 +1,351 @@
+package archiver
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangeKind describes how a path differs between an old and a new tree, as
+// reported by Changes.
+type ChangeKind int
+
+const (
+	ChangeAdd ChangeKind = iota
+	ChangeModify
+	ChangeDelete
+)
+
+// Change describes a single path that differs between an old and a new tree.
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// whiteoutPrefix marks a deleted path in a TarChanges archive, following the
+// AUFS convention also used by Docker's layered filesystem.
+const whiteoutPrefix = ".wh."
+
+// Changes walks oldDir and newDir in lockstep, comparing each path present
+// in either tree, and returns every path that was added, modified or
+// deleted going from oldDir to newDir. A path is reported as modified if
+// its size or mode differs; symlinks with equal size and mode are compared
+// by target, and other files with equal size and mode are hashed with
+// SHA-256 only when their mtime differs, so a copy with a new mtime but the
+// same content isn't reported as a change.
+func Changes(oldDir, newDir string) ([]Change, error) {
+	oldEntries, err := walkPathEntries(oldDir)
+	if err != nil {
+		return nil, err
+	}
+
+	newEntries, err := walkPathEntries(newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		switch {
+		case j >= len(newEntries) || (i < len(oldEntries) && oldEntries[i].path < newEntries[j].path):
+			changes = append(changes, Change{Path: oldEntries[i].path, Kind: ChangeDelete})
+			i++
+		case i >= len(oldEntries) || newEntries[j].path < oldEntries[i].path:
+			changes = append(changes, Change{Path: newEntries[j].path, Kind: ChangeAdd})
+			j++
+		default:
+			equal, err := entriesEqual(oldEntries[i], newEntries[j])
+			if err != nil {
+				return nil, err
+			} else if !equal {
+				changes = append(changes, Change{Path: newEntries[j].path, Kind: ChangeModify})
+			}
+			i++
+			j++
+		}
+	}
+
+	return changes, nil
+}
+
+// pathEntry is a single file or directory discovered while walking a tree
+// for Changes, recorded with both its path relative to the tree root and
+// its absolute path for opening/hashing.
+type pathEntry struct {
+	path    string
+	absPath string
+	fi      os.FileInfo
+}
+
+// walkPathEntries walks root and returns every path under it, relative to
+// root, sorted by path. filepath.Walk's depth-first order is not plain
+// string order ("a", "a/b", "a-c"), which the lockstep merge in Changes
+// relies on, so the entries are sorted after the walk.
+func walkPathEntries(root string) ([]pathEntry, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []pathEntry
+	err = filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(absRoot, absFile)
+		if err != nil {
+			return err
+		} else if relPath == "." {
+			return nil
+		}
+
+		entries = append(entries, pathEntry{path: relPath, absPath: absFile, fi: fi})
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+	return entries, err
+}
+
+// entriesEqual reports whether two pathEntries - one from the old tree, one
+// from the new - refer to unchanged content.
+func entriesEqual(oldEntry, newEntry pathEntry) (bool, error) {
+	if oldEntry.fi.Size() != newEntry.fi.Size() || oldEntry.fi.Mode() != newEntry.fi.Mode() {
+		return false, nil
+	} else if oldEntry.fi.IsDir() {
+		return true, nil
+	} else if oldEntry.fi.Mode()&os.ModeSymlink != 0 {
+		return symlinksEqual(oldEntry.absPath, newEntry.absPath)
+	} else if oldEntry.fi.ModTime().Equal(newEntry.fi.ModTime()) {
+		return true, nil
+	}
+
+	oldHash, err := hashFile(oldEntry.absPath)
+	if err != nil {
+		return false, err
+	}
+
+	newHash, err := hashFile(newEntry.absPath)
+	if err != nil {
+		return false, err
+	}
+
+	return oldHash == newHash, nil
+}
+
+// symlinksEqual compares two symlinks by their recorded target rather than
+// by content: following them with os.Open would hash whatever they point
+// at instead of the link itself, and fails outright for an ordinary
+// dangling symlink.
+func symlinksEqual(oldPath, newPath string) (bool, error) {
+	oldTarget, err := os.Readlink(oldPath)
+	if err != nil {
+		return false, err
+	}
+
+	newTarget, err := os.Readlink(newPath)
+	if err != nil {
+		return false, err
+	}
+
+	return oldTarget == newTarget, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+
+	return string(hasher.Sum(nil)), nil
+}
+
+// TarChanges writes changes, as produced by Changes, to w as a tar archive:
+// added and modified paths are copied in full from newDir, and deletions
+// are represented by a zero-size whiteout entry (".wh.<basename>"),
+// following the AUFS convention used by Docker's layered filesystem. A
+// change is skipped if its path is ignored per the same nested .gitignore
+// rules Tar honors - not just a root-level .gitignore - whether it's an
+// add, a modify or a deletion.
+func TarChanges(newDir string, changes []Change, w io.Writer, opts ...TarOption) error {
+	tarOpts := defaultOpts()
+	for _, opt := range opts {
+		opt(tarOpts)
+	}
+
+	absNewDir, err := filepath.Abs(newDir)
+	if err != nil {
+		return err
+	}
+
+	baseIgnores, err := newIgnoreStack(tarOpts, absNewDir)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	for _, change := range changes {
+		ignored, err := ignoresChange(baseIgnores, absNewDir, change.Path, tarOpts.honorGitIgnore)
+		if err != nil {
+			return err
+		} else if ignored {
+			continue
+		}
+
+		switch change.Kind {
+		case ChangeDelete:
+			if err := writeWhiteout(tw, rebaseName(change.Path, tarOpts.rebaseNames)); err != nil {
+				return err
+			}
+		case ChangeAdd, ChangeModify:
+			if err := writeChangedFile(tw, newDir, change.Path, tarOpts.rebaseNames); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ignoresChange reports whether relPath is ignored, honoring every
+// .gitignore between absNewDir and relPath's parent directory - not just
+// the ones that happen to belong to a directory that itself shows up as a
+// change - mirroring Tar's own walk, which only descends into a nested
+// .gitignore when honorGitIgnore is set. Unlike that walk, which pushes a
+// directory's .gitignore only once it actually descends into it, a change
+// list can jump straight to a deeply nested path whose ancestor
+// directories never changed, so the stack is rebuilt from base fresh for
+// each change instead of carried across the loop.
+func ignoresChange(base *ignoreStack, absNewDir, relPath string, honorGitIgnore bool) (bool, error) {
+	stack := &ignoreStack{entries: append([]scopedIgnore(nil), base.entries...)}
+
+	if !honorGitIgnore {
+		return stack.matches(relPath), nil
+	}
+
+	var ancestors []string
+	for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+		ancestors = append(ancestors, dir)
+	}
+
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		if err := stack.enter(ancestors[i], filepath.Join(absNewDir, ancestors[i])); err != nil {
+			return false, err
+		}
+	}
+
+	return stack.matches(relPath), nil
+}
+
+// writeWhiteout writes the whiteout entry that marks relPath as deleted.
+func writeWhiteout(tw *tar.Writer, relPath string) error {
+	dir, base := filepath.Split(relPath)
+	header := &tar.Header{
+		Name:     filepath.Join(dir, whiteoutPrefix+base),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	}
+	return tw.WriteHeader(header)
+}
+
+// writeChangedFile writes the added/modified file at relPath (under
+// newDir) to tw, following symlinks only to read their own target, not to
+// resolve through them.
+func writeChangedFile(tw *tar.Writer, newDir, relPath string, rebase map[string]string) error {
+	fullPath := filepath.Join(newDir, relPath)
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	var linkname string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		linkname, err = os.Readlink(fullPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, linkname)
+	if err != nil {
+		return err
+	}
+	header.Name = rebaseName(relPath, rebase)
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ApplyLayer extracts a tar stream produced by TarChanges into dst: regular
+// entries are extracted as usual, while a whiteout entry removes the path
+// it shadows instead of being written out itself.
+func ApplyLayer(dst string, r io.Reader) error {
+	tarOpts := defaultOpts()
+
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		dir, base := filepath.Split(header.Name)
+		if !strings.HasPrefix(base, whiteoutPrefix) {
+			if err := extractEntry(tr, header, absDst, tarOpts); err != nil {
+				return err
+			}
+			continue
+		}
+
+		target := filepath.Clean(filepath.Join(absDst, dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		if !withinRoot(target, absDst) {
+			return fmt.Errorf("illegal file path: [%s]", target)
+		}
+
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package archiver
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangesAndApplyLayer(t *testing.T) {
+	oldDir, err := ioutil.TempDir("", "TestChangesAndApplyLayer-old-")
+	assert.Nil(t, err)
+	newDir, err := ioutil.TempDir("", "TestChangesAndApplyLayer-new-")
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(oldDir, "unchanged.txt"), []byte("same"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newDir, "unchanged.txt"), []byte("same"), 0644))
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(oldDir, "modified.txt"), []byte("before"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newDir, "modified.txt"), []byte("after"), 0644))
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(oldDir, "deleted.txt"), []byte("gone"), 0644))
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newDir, "added.txt"), []byte("new"), 0644))
+
+	changes, err := Changes(oldDir, newDir)
+	assert.Nil(t, err)
+
+	byPath := map[string]ChangeKind{}
+	for _, c := range changes {
+		byPath[c.Path] = c.Kind
+	}
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, ChangeModify, byPath["modified.txt"])
+	assert.Equal(t, ChangeDelete, byPath["deleted.txt"])
+	assert.Equal(t, ChangeAdd, byPath["added.txt"])
+
+	file, err := ioutil.TempFile("", "TestChangesAndApplyLayer-layer-")
+	assert.Nil(t, err)
+	assert.Nil(t, TarChanges(newDir, changes, file))
+	assert.Nil(t, file.Close())
+
+	layer, err := os.Open(file.Name())
+	assert.Nil(t, err)
+	defer layer.Close()
+
+	// seed the apply destination with a copy of oldDir so the whiteout has
+	// something to remove
+	assert.Nil(t, copyTree(oldDir, oldDir+"-dst"))
+	defer os.RemoveAll(oldDir + "-dst")
+
+	assert.Nil(t, ApplyLayer(oldDir+"-dst", layer))
+
+	_, err = os.Stat(filepath.Join(oldDir+"-dst", "deleted.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	content, err := ioutil.ReadFile(filepath.Join(oldDir+"-dst", "modified.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "after", string(content))
+
+	content, err = ioutil.ReadFile(filepath.Join(oldDir+"-dst", "added.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(content))
+}
+
+func TestChangesIgnoresUnchangedSymlink(t *testing.T) {
+	oldDir, err := ioutil.TempDir("", "TestChangesIgnoresUnchangedSymlink-old-")
+	assert.Nil(t, err)
+	newDir, err := ioutil.TempDir("", "TestChangesIgnoresUnchangedSymlink-new-")
+	assert.Nil(t, err)
+
+	// a dangling symlink is an ordinary case - the target need not exist
+	// for the comparison to succeed
+	assert.Nil(t, os.Symlink("missing-target", filepath.Join(oldDir, "link")))
+	assert.Nil(t, os.Symlink("missing-target", filepath.Join(newDir, "link")))
+
+	changes, err := Changes(oldDir, newDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changes))
+}
+
+func TestChangesReportsRetargetedSymlink(t *testing.T) {
+	oldDir, err := ioutil.TempDir("", "TestChangesReportsRetargetedSymlink-old-")
+	assert.Nil(t, err)
+	newDir, err := ioutil.TempDir("", "TestChangesReportsRetargetedSymlink-new-")
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.Symlink("old-target", filepath.Join(oldDir, "link")))
+	assert.Nil(t, os.Symlink("new-target", filepath.Join(newDir, "link")))
+
+	changes, err := Changes(oldDir, newDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, ChangeModify, changes[0].Kind)
+}
+
+func TestTarChangesHonorsNestedGitignore(t *testing.T) {
+	oldDir, err := ioutil.TempDir("", "TestTarChangesHonorsNestedGitignore-old-")
+	assert.Nil(t, err)
+	newDir, err := ioutil.TempDir("", "TestTarChangesHonorsNestedGitignore-new-")
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newDir, ".gitignore"), []byte("*.log\n"), 0644))
+
+	assert.Nil(t, os.Mkdir(filepath.Join(newDir, "d1"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newDir, "d1", ".gitignore"), []byte("*.log\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newDir, "d1", "ignored.log"), []byte("noise"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newDir, "d1", "kept.txt"), []byte("keep"), 0644))
+
+	// unchanged between old and new, so it never shows up as a Change
+	// itself - the .gitignore nested below it still has to be honored
+	assert.Nil(t, os.Mkdir(filepath.Join(oldDir, "d1"), 0755))
+
+	// deleted, and ignored by the root .gitignore - ignore matching has to
+	// apply to deletions too, not just adds and modifies
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(oldDir, "deleted.log"), []byte("gone"), 0644))
+
+	changes, err := Changes(oldDir, newDir)
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, TarChanges(newDir, changes, &buf, HonorGitIgnore()))
+
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		names = append(names, header.Name)
+	}
+
+	assert.Contains(t, names, filepath.Join("d1", "kept.txt"))
+	assert.NotContains(t, names, filepath.Join("d1", "ignored.log"))
+	assert.NotContains(t, names, whiteoutPrefix+"deleted.log")
+}
+
+func copyTree(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, entry.Name()), content, entry.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package archiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression identifies the codec a stream is (or should be) compressed with.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Bzip2
+	Xz
+	Zstd
+)
+
+// magic numbers used by DetectCompression to peek at the head of a stream.
+var magicNumbers = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{Gzip, []byte{0x1F, 0x8B}},
+	{Bzip2, []byte{0x42, 0x5A, 0x68}},
+	{Xz, []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}},
+	{Zstd, []byte{0x28, 0xB5, 0x2F, 0xFD}},
+}
+
+// DetectCompression inspects the leading bytes of buf and returns the codec
+// that produced them, or Uncompressed if none of the known magic numbers match.
+func DetectCompression(buf []byte) Compression {
+	for _, m := range magicNumbers {
+		if len(buf) >= len(m.magic) && bytes.Equal(buf[:len(m.magic)], m.magic) {
+			return m.compression
+		}
+	}
+	return Uncompressed
+}
+
+// IsArchive reports whether buf starts with a magic number recognized by
+// DetectCompression.
+func IsArchive(buf []byte) bool {
+	return DetectCompression(buf) != Uncompressed
+}
+
+// Compress fronts Tar with the given compression codec, writing a compressed
+// archive of source to writer.
+func Compress(source string, writer io.Writer, compression Compression, opts ...TarOption) error {
+	tarOpts := defaultOpts()
+	for _, opt := range opts {
+		opt(tarOpts)
+	}
+
+	// BandwidthLimit must wrap the real sink, outside the compressor, so it
+	// throttles the compressed bytes actually hitting writer rather than
+	// the larger, pre-compression tar stream fed into the compressor.
+	if tarOpts.bandwidthLimit > 0 {
+		limiter := newRateLimitedWriter(writer, tarOpts.bandwidthLimit)
+		defer limiter.Close()
+		writer = limiter
+	}
+
+	compressor, err := newCompressWriter(writer, compression, tarOpts)
+	if err != nil {
+		return err
+	}
+	defer compressor.Close()
+
+	return tarWithOpts(source, compressor, tarOpts)
+}
+
+// Decompress peeks at the first few bytes of r to detect its compression
+// codec, transparently decompresses it, and untars the result into destination.
+// An uncompressed tar stream is untarred as-is.
+func Decompress(destination string, r io.Reader) error {
+	buffered := bufio.NewReaderSize(r, 10)
+	header, err := buffered.Peek(10)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	decompressor, err := newDecompressReader(buffered, DetectCompression(header))
+	if err != nil {
+		return err
+	}
+	if closer, ok := decompressor.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	return Untar(destination, decompressor)
+}
+
+// newCompressWriter wraps writer so that whatever is written to the result
+// ends up compressed with the given codec.
+func newCompressWriter(writer io.Writer, compression Compression, tarOpts *tarOptions) (io.WriteCloser, error) {
+	switch compression {
+	case Uncompressed:
+		return nopWriteCloser{writer}, nil
+	case Gzip:
+		if tarOpts.parallelGzip {
+			return newParallelGzipWriter(writer, tarOpts)
+		}
+		return gzip.NewWriterLevel(writer, tarOpts.level)
+	case Bzip2:
+		return bzip2.NewWriter(writer, nil)
+	case Xz:
+		return xz.NewWriter(writer)
+	case Zstd:
+		return zstd.NewWriter(writer)
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", compression)
+	}
+}
+
+// newDecompressReader wraps reader so that reads from the result produce the
+// decompressed stream for the given codec.
+func newDecompressReader(reader io.Reader, compression Compression) (io.Reader, error) {
+	switch compression {
+	case Uncompressed:
+		return reader, nil
+	case Gzip:
+		return gzip.NewReader(reader)
+	case Bzip2:
+		return bzip2.NewReader(reader, nil)
+	case Xz:
+		return xz.NewReader(reader)
+	case Zstd:
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", compression)
+	}
+}
+
+// nopWriteCloser adapts an io.Writer to io.WriteCloser for the Uncompressed case.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,56 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		buf      []byte
+		expected Compression
+	}{
+		{[]byte{0x1F, 0x8B, 0x08}, Gzip},
+		{[]byte{0x42, 0x5A, 0x68, 0x39}, Bzip2},
+		{[]byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, Xz},
+		{[]byte{0x28, 0xB5, 0x2F, 0xFD}, Zstd},
+		{[]byte("hello world"), Uncompressed},
+		{[]byte{}, Uncompressed},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, DetectCompression(test.buf))
+		assert.Equal(t, test.expected != Uncompressed, IsArchive(test.buf))
+	}
+}
+
+func TestCompressDecompressZstd(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "TestCompressDecompressZstd-src-")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(srcDir, "f1.txt"), []byte("hello"), 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(srcDir, "d1"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(srcDir, "d1", "f11.txt"), []byte("world"), 0644))
+
+	file, err := ioutil.TempFile("", "TestCompressDecompressZstd-file-")
+	assert.Nil(t, err)
+
+	err = Compress(srcDir, file, Zstd)
+	assert.Nil(t, err)
+	err = file.Close()
+	assert.Nil(t, err)
+
+	tempDir, err := ioutil.TempDir("", "TestCompressDecompressZstd-dir-")
+	assert.Nil(t, err)
+	file, err = os.Open(file.Name())
+	assert.Nil(t, err)
+	defer file.Close()
+
+	err = Decompress(tempDir, file)
+	assert.Nil(t, err)
+
+	assertFoldersEqual(t, srcDir, tempDir, 3, map[string]bool{})
+}
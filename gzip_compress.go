@@ -23,27 +23,17 @@ func CompressionLevel(level int) TarOption {
 }
 
 // GzipCompress fronts tar with a gzip compression stream.
+//
+// Deprecated: use Compress(source, writer, Gzip, opts...) which also
+// handles bzip2, xz and zstd.
 func GzipCompress(source string, writer io.Writer, opts ...TarOption) error {
-	tarOpts := defaultOpts()
-	for _, opt := range opts {
-		opt(tarOpts)
-	}
-
-	compressor, err := gzip.NewWriterLevel(writer, tarOpts.level)
-	if err != nil {
-		return err
-	}
-
-	defer compressor.Close()
-	return tarWithOpts(source, compressor, tarOpts)
+	return Compress(source, writer, Gzip, opts...)
 }
 
 // GzipDecompress fronts tar with a gzip decompression stream.
+//
+// Deprecated: use Decompress(destination, r), which auto-detects the
+// codec instead of assuming gzip.
 func GzipDecompress(destination string, r io.Reader) error {
-	compressor, err := gzip.NewReader(r)
-	if err != nil {
-		return err
-	}
-
-	return Untar(destination, compressor)
+	return Decompress(destination, r)
 }
@@ -0,0 +1,157 @@
+package archiver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	gitignore "github.com/sabhiram/go-gitignore"
+)
+
+// scopedIgnore pairs a compiled gitignore matcher with the directory
+// (relative to the archive source, "." for the source root) whose
+// .gitignore produced it.
+//
+// probe is the same lines compiled with a leading catch-all "*" pattern.
+// GitIgnore's own negate handling only fires once some earlier pattern in
+// the same matcher has already flagged a path as ignored, so a scope whose
+// only relevant rule is a bare "!foo" re-include can never be detected from
+// ignorer alone - MatchesPathHow returns a nil pattern for it exactly as it
+// would for a scope with no opinion at all. The catch-all seeds that prior
+// "ignored" state so probe reports, via a non-nil pattern with ignored
+// false, that this scope's own patterns re-include the path.
+type scopedIgnore struct {
+	scope   string
+	ignorer *gitignore.GitIgnore
+	probe   *gitignore.GitIgnore
+}
+
+// ignoreStack tracks every .gitignore matcher currently in scope while
+// filepath.Walk descends a tree, so a file is checked against every
+// .gitignore between it and the archive root - not just the root's.
+type ignoreStack struct {
+	entries []scopedIgnore
+}
+
+// newIgnoreStack seeds the stack with the always-on, root-scoped matchers
+// tarOpts asks for (.git, .git/info/exclude, ExcludePatterns) and, if
+// honorGitIgnore is set, the root .gitignore itself.
+func newIgnoreStack(tarOpts *tarOptions, absSource string) (*ignoreStack, error) {
+	stack := &ignoreStack{}
+
+	if tarOpts.ignoreDotGit {
+		stack.push(".", []string{"**/.git"})
+	}
+
+	if tarOpts.honorGitInfoExclude {
+		excludePath := filepath.Join(absSource, ".git", "info", "exclude")
+		if _, err := os.Stat(excludePath); err == nil {
+			lines, err := readLines(excludePath)
+			if err != nil {
+				return nil, err
+			}
+			stack.push(".", lines)
+		}
+	}
+
+	if len(tarOpts.excludePatterns) > 0 {
+		stack.push(".", tarOpts.excludePatterns)
+	}
+
+	if tarOpts.honorGitIgnore {
+		gitignorePath := filepath.Join(absSource, ".gitignore")
+		if _, err := os.Stat(gitignorePath); err == nil {
+			lines, err := readLines(gitignorePath)
+			if err != nil {
+				return nil, err
+			}
+			// a .gitignore is never archived itself, regardless of depth
+			stack.push(".", append(lines, ".gitignore"))
+		}
+	}
+
+	return stack, nil
+}
+
+func (s *ignoreStack) push(scope string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+
+	s.entries = append(s.entries, scopedIgnore{
+		scope:   scope,
+		ignorer: gitignore.CompileIgnoreLines(lines...),
+		probe:   gitignore.CompileIgnoreLines(append([]string{"*"}, lines...)...),
+	})
+}
+
+// enter pushes the .gitignore found directly inside the directory at
+// relScope/absDir, if any. It is a no-op if that directory has none.
+func (s *ignoreStack) enter(relScope, absDir string) error {
+	gitignorePath := filepath.Join(absDir, ".gitignore")
+	if _, err := os.Stat(gitignorePath); err != nil {
+		return nil
+	}
+
+	lines, err := readLines(gitignorePath)
+	if err != nil {
+		return err
+	}
+
+	s.push(relScope, lines)
+	return nil
+}
+
+// readLines reads path and splits it into lines, the form push and
+// CompileIgnoreLines expect.
+func readLines(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(string(content), "\n"), nil
+}
+
+// leave pops every scope that is not dir itself or one of its ancestors,
+// called as the walk moves on to a path outside the deepest pushed scope.
+func (s *ignoreStack) leave(dir string) {
+	for len(s.entries) > 0 {
+		scope := s.entries[len(s.entries)-1].scope
+		if scope == "." || scope == dir || strings.HasPrefix(dir+string(filepath.Separator), scope+string(filepath.Separator)) {
+			return
+		}
+		s.entries = s.entries[:len(s.entries)-1]
+	}
+}
+
+// matches reports whether relPath is ignored. Scopes are consulted from
+// deepest to shallowest, and the first one whose own patterns reference
+// relPath at all (to ignore or, via a "!" pattern, to re-include) decides
+// the outcome - so a deeper .gitignore always overrides a shallower one.
+// Each scope's patterns are matched against relPath made relative to that
+// scope, not the archive root, so an anchored pattern like "/build" in a
+// nested .gitignore means "this directory's own build", matching the same
+// semantics git itself gives it.
+func (s *ignoreStack) matches(relPath string) bool {
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		scopedPath := relPath
+		if e.scope != "." {
+			rel, err := filepath.Rel(e.scope, relPath)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			scopedPath = rel
+		}
+
+		if ignored, pattern := e.ignorer.MatchesPathHow(scopedPath); pattern != nil {
+			return ignored
+		}
+
+		if reincluded, pattern := e.probe.MatchesPathHow(scopedPath); pattern != nil && !reincluded {
+			return false
+		}
+	}
+	return false
+}
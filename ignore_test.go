@@ -0,0 +1,55 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreStackNestedPrecedence(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestIgnoreStackNestedPrecedence-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "d1"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "d1", ".gitignore"), []byte("!keep.log\n"), 0644))
+
+	tarOpts := defaultOpts()
+	tarOpts.honorGitIgnore = true
+
+	stack, err := newIgnoreStack(tarOpts, root)
+	assert.Nil(t, err)
+	assert.True(t, stack.matches("other.log"))
+
+	assert.Nil(t, stack.enter("d1", filepath.Join(root, "d1")))
+	assert.False(t, stack.matches("d1/keep.log"))
+	assert.True(t, stack.matches("d1/other.log"))
+
+	stack.leave(".")
+	assert.True(t, stack.matches("d1/keep.log"))
+}
+
+func TestIgnoreStackNestedAnchoredPattern(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestIgnoreStackNestedAnchoredPattern-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "d1", "sub"), 0755))
+	// anchored to d1 itself: only d1/build is meant to be ignored, not
+	// d1/sub/build
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "d1", ".gitignore"), []byte("/build\n"), 0644))
+
+	tarOpts := defaultOpts()
+	tarOpts.honorGitIgnore = true
+
+	stack, err := newIgnoreStack(tarOpts, root)
+	assert.Nil(t, err)
+
+	assert.Nil(t, stack.enter("d1", filepath.Join(root, "d1")))
+	assert.True(t, stack.matches("d1/build"))
+	assert.False(t, stack.matches("d1/sub/build"))
+}
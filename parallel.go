@@ -0,0 +1,135 @@
+package archiver
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/pgzip"
+)
+
+// ParallelGzip swaps the gzip codec used by Compress and GzipCompress for
+// github.com/klauspost/pgzip, splitting the stream into independently
+// compressed blocks so multiple cores can be used on large trees.
+func ParallelGzip(blockSize, blocks int) TarOption {
+	return func(opts *tarOptions) {
+		opts.parallelGzip = true
+		opts.pgzipBlockSize = blockSize
+		opts.pgzipBlocks = blocks
+	}
+}
+
+// BandwidthLimit throttles the writer Tar/Compress write to, capping it at
+// roughly bytesPerSec bytes per second.
+func BandwidthLimit(bytesPerSec int64) TarOption {
+	return func(opts *tarOptions) {
+		opts.bandwidthLimit = bytesPerSec
+	}
+}
+
+// Progress registers a callback invoked periodically, from a background
+// goroutine, with the cumulative bytes and files written to the archive so
+// far. It is called once more, with the final totals, right before Tar or
+// Compress returns.
+func Progress(report func(bytesWritten, filesWritten int64)) TarOption {
+	return func(opts *tarOptions) {
+		opts.progress = report
+	}
+}
+
+// newParallelGzipWriter builds a pgzip.Writer configured per the
+// ParallelGzip TarOption.
+func newParallelGzipWriter(writer io.Writer, tarOpts *tarOptions) (io.WriteCloser, error) {
+	pw, err := pgzip.NewWriterLevel(writer, tarOpts.level)
+	if err != nil {
+		return nil, err
+	}
+
+	if tarOpts.pgzipBlockSize > 0 && tarOpts.pgzipBlocks > 0 {
+		if err := pw.SetConcurrency(tarOpts.pgzipBlockSize, tarOpts.pgzipBlocks); err != nil {
+			return nil, err
+		}
+	}
+
+	return pw, nil
+}
+
+// countingWriter tracks the cumulative number of bytes written through it,
+// so a Progress callback can report on it from another goroutine.
+type countingWriter struct {
+	io.Writer
+	bytesWritten int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	atomic.AddInt64(&c.bytesWritten, int64(n))
+	return n, err
+}
+
+// reportProgress calls report with counter's and filesWritten's current
+// values every tick, until done is closed, then once more with the final
+// values before closing finished - so a caller that blocks on finished
+// is guaranteed to observe the final call before it unblocks.
+func reportProgress(report func(bytesWritten, filesWritten int64), counter *countingWriter, filesWritten *int64, done <-chan struct{}, finished chan<- struct{}) {
+	defer close(finished)
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report(atomic.LoadInt64(&counter.bytesWritten), atomic.LoadInt64(filesWritten))
+		case <-done:
+			report(atomic.LoadInt64(&counter.bytesWritten), atomic.LoadInt64(filesWritten))
+			return
+		}
+	}
+}
+
+// rateLimitedWriter throttles writes to roughly bytesPerSec bytes per
+// second using a token bucket refilled once a second.
+type rateLimitedWriter struct {
+	io.Writer
+	bytesPerSec int64
+	tokens      int64
+	ticker      *time.Ticker
+}
+
+func newRateLimitedWriter(writer io.Writer, bytesPerSec int64) *rateLimitedWriter {
+	return &rateLimitedWriter{
+		Writer:      writer,
+		bytesPerSec: bytesPerSec,
+		tokens:      bytesPerSec,
+		ticker:      time.NewTicker(time.Second),
+	}
+}
+
+func (r *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if r.tokens <= 0 {
+			<-r.ticker.C
+			r.tokens = r.bytesPerSec
+		}
+
+		chunk := p
+		if int64(len(chunk)) > r.tokens {
+			chunk = chunk[:r.tokens]
+		}
+
+		n, err := r.Writer.Write(chunk)
+		written += n
+		r.tokens -= int64(n)
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (r *rateLimitedWriter) Close() {
+	r.ticker.Stop()
+}
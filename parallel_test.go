@@ -0,0 +1,91 @@
+package archiver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	counter := &countingWriter{Writer: &buf}
+
+	n, err := counter.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, int64(5), counter.bytesWritten)
+
+	_, err = counter.Write([]byte(" world"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), counter.bytesWritten)
+}
+
+func TestRateLimitedWriterWithinBudget(t *testing.T) {
+	var buf bytes.Buffer
+	limiter := newRateLimitedWriter(&buf, 1024)
+	defer limiter.Close()
+
+	n, err := limiter.Write([]byte("small write, well under the per-second budget"))
+	assert.Nil(t, err)
+	assert.Equal(t, 45, n)
+	assert.Equal(t, "small write, well under the per-second budget", buf.String())
+}
+
+func TestRateLimitedWriterBlocksOnceBudgetIsExhausted(t *testing.T) {
+	var buf bytes.Buffer
+	limiter := newRateLimitedWriter(&buf, 10)
+	defer limiter.Close()
+
+	start := time.Now()
+	n, err := limiter.Write([]byte("this write is well over the ten byte per second budget"))
+	elapsed := time.Since(start)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 54, n)
+	assert.Equal(t, "this write is well over the ten byte per second budget", buf.String())
+	// exhausting the initial 10 tokens forces at least one wait on the
+	// once-a-second ticker before the rest of the write can go through
+	assert.True(t, elapsed >= 900*time.Millisecond, "expected Write to block for a refill, took %s", elapsed)
+}
+
+func TestReportProgress(t *testing.T) {
+	var buf bytes.Buffer
+	counter := &countingWriter{Writer: &buf}
+	counter.bytesWritten = 42
+	filesWritten := int64(3)
+
+	var gotBytes, gotFiles int64
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go reportProgress(func(bytesWritten, files int64) {
+		gotBytes, gotFiles = bytesWritten, files
+	}, counter, &filesWritten, done, finished)
+
+	close(done)
+	<-finished
+
+	assert.Equal(t, int64(42), gotBytes)
+	assert.Equal(t, int64(3), gotFiles)
+}
+
+func TestTarProgressFiresFinalCallBeforeReturning(t *testing.T) {
+	src, err := ioutil.TempDir("", "TestTarProgressFiresFinalCallBeforeReturning-")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "file.txt"), []byte("hello world"), 0644))
+
+	var gotBytes, gotFiles int64
+	var buf bytes.Buffer
+	err = Tar(src, &buf, Progress(func(bytesWritten, filesWritten int64) {
+		gotBytes, gotFiles = bytesWritten, filesWritten
+	}))
+	assert.Nil(t, err)
+
+	// Tar must not return until the final report call lands - otherwise a
+	// caller reading gotBytes/gotFiles right after Tar returns would race it.
+	assert.Equal(t, int64(buf.Len()), gotBytes)
+	assert.Equal(t, int64(1), gotFiles)
+}